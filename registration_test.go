@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -15,8 +22,107 @@ const (
 	MediaTypeJSONLD           = "application/ld+json"
 	MediaTypeThingDescription = "application/td+json"
 	MediaTypeMergePatch       = "application/merge-patch+json"
+	MediaTypeJSONPatch        = "application/json-patch+json"
+	MediaTypeEventStream      = "text/event-stream"
 )
 
+// sseEvent is a single decoded frame from a `text/event-stream` response.
+type sseEvent struct {
+	event string
+	data  string
+	id    string
+}
+
+// subscribeSSE opens a long-lived GET request against url and decodes frames
+// into events until ctx is done or the connection is closed. The returned
+// stop func cancels the subscription and must be called to release resources.
+// If lastEventID is non-empty it is sent as the `Last-Event-ID` header so the
+// server can replay missed events.
+func subscribeSSE(ctx context.Context, t *testing.T, url string, lastEventID string) (<-chan sseEvent, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Error building SSE request: %s", err)
+	}
+	req.Header.Set("Accept", MediaTypeEventStream)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error opening SSE connection: %s", err)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		defer res.Body.Close()
+
+		scanner := bufio.NewScanner(res.Body)
+		var cur sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if cur.event != "" {
+					select {
+					case events <- cur:
+					case <-ctx.Done():
+						return
+					}
+				}
+				cur = sseEvent{}
+			case strings.HasPrefix(line, "event:"):
+				cur.event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				cur.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			case strings.HasPrefix(line, "id:"):
+				cur.id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+			}
+		}
+	}()
+
+	return events, func() {
+		cancel()
+		res.Body.Close()
+	}
+}
+
+// waitForEvent reads from events until one with the given event type arrives
+// or timeout elapses.
+func waitForEvent(t *testing.T, events <-chan sseEvent, want string, timeout time.Duration) sseEvent {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("SSE stream closed before %q event arrived", want)
+			}
+			if ev.event == want {
+				return ev
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for %q event", want)
+		}
+	}
+}
+
+func assertEventRefersTo(ev sseEvent, id string, t *testing.T) {
+	t.Helper()
+
+	if !strings.Contains(ev.data, id) {
+		t.Fatalf("Event data does not contain affected TD id %q. Got: %s", id, ev.data)
+	}
+	if ev.id == "" {
+		t.Fatalf("Event is missing the id: field required for Last-Event-ID cursoring")
+	}
+}
+
 func TestCreateAnonymousThing(t *testing.T) {
 	t.Cleanup(func() {
 		writeTestResult("create-anonymous-thing", "", t)
@@ -232,40 +338,186 @@ func TestUpdateThing(t *testing.T) {
 	})
 }
 
+// patchCase is a single conformance scenario that can be driven through
+// either JSON Merge Patch (RFC 7386) or JSON Patch (RFC 6902), so both media
+// types are checked against the same expected outcome.
+type patchCase struct {
+	name           string
+	setup          func(td mapAny)
+	mergePatchBody string
+	jsonPatchBody  string
+	expectedStatus int
+	// expect mutates the reference td in-place to what the server is
+	// expected to store. Left nil for cases that aren't expected to succeed.
+	expect func(td mapAny)
+}
+
+var patchMatrix = []patchCase{
+	{
+		name:           "replace title",
+		mergePatchBody: `{"title": "new title"}`,
+		jsonPatchBody:  `[{"op": "replace", "path": "/title", "value": "new title"}]`,
+		expectedStatus: http.StatusOK,
+		expect: func(td mapAny) {
+			td["title"] = "new title"
+		},
+	},
+	{
+		name: "remove description",
+		setup: func(td mapAny) {
+			td["description"] = "this is a test descr"
+		},
+		mergePatchBody: `{"description": null}`,
+		jsonPatchBody:  `[{"op": "remove", "path": "/description"}]`,
+		expectedStatus: http.StatusOK,
+		expect: func(td mapAny) {
+			delete(td, "description")
+		},
+	},
+	{
+		name: "add nested property",
+		setup: func(td mapAny) {
+			td["properties"] = mapAny{
+				"status": mapAny{
+					"forms": []mapAny{
+						{"href": "https://mylamp.example.com/status"},
+					},
+				},
+			}
+		},
+		mergePatchBody: `{"properties": {"new_property": {"forms": [{"href": "https://mylamp.example.com/new_property"}]}}}`,
+		jsonPatchBody:  `[{"op": "add", "path": "/properties/new_property", "value": {"forms": [{"href": "https://mylamp.example.com/new_property"}]}}]`,
+		expectedStatus: http.StatusOK,
+		expect: func(td mapAny) {
+			td["properties"].(mapAny)["new_property"] = mapAny{
+				"forms": []mapAny{
+					{"href": "https://mylamp.example.com/new_property"},
+				},
+			}
+		},
+	},
+	{
+		name: "replace array",
+		setup: func(td mapAny) {
+			td["properties"] = mapAny{
+				"status": mapAny{
+					"forms": []mapAny{
+						{"href": "https://mylamp.example.com/status"},
+					},
+				},
+			}
+		},
+		mergePatchBody: `{"properties": {"status": {"forms": [
+					{"href": "https://mylamp.example.com/status"},
+					{"href": "coaps://mylamp.example.com/status"}
+				]}}}`,
+		jsonPatchBody: `[{"op": "replace", "path": "/properties/status/forms", "value": [
+					{"href": "https://mylamp.example.com/status"},
+					{"href": "coaps://mylamp.example.com/status"}
+				]}]`,
+		expectedStatus: http.StatusOK,
+		expect: func(td mapAny) {
+			td["properties"].(mapAny)["status"].(mapAny)["forms"] = []mapAny{
+				{"href": "https://mylamp.example.com/status"},
+				{"href": "coaps://mylamp.example.com/status"},
+			}
+		},
+	},
+	{
+		name:           "fail removing mandatory title",
+		mergePatchBody: `{"title": null}`,
+		jsonPatchBody:  `[{"op": "remove", "path": "/title"}]`,
+		expectedStatus: http.StatusBadRequest,
+	},
+}
+
+// runPatchCase seeds a TD per tc.setup, submits body with contentType, and
+// asserts the status code and (for expected successes) the resulting TD.
+func runPatchCase(t *testing.T, tc patchCase, contentType, body string) {
+	id := "urn:uuid:" + uuid.NewV4().String()
+	td := mockedTD(id)
+	if tc.setup != nil {
+		tc.setup(td)
+	}
+	createThing(id, td, t)
+
+	res, err := httpPatch(serverURL+"/things/"+id, contentType, []byte(body))
+	if err != nil {
+		t.Fatalf("Error patching TD: %s", err)
+	}
+	defer res.Body.Close()
+
+	resBody := httpReadBody(res, t)
+
+	t.Run("status code", func(t *testing.T) {
+		assertStatusCode(res.StatusCode, tc.expectedStatus, resBody, t)
+	})
+
+	if tc.expectedStatus != http.StatusOK || tc.expect == nil {
+		return
+	}
+
+	t.Run("result", func(t *testing.T) {
+		storedTD := retrieveThing(id, t)
+
+		tc.expect(td)
+		td["registration"] = storedTD["registration"]
+
+		if !serializedEqual(td, storedTD) {
+			t.Fatalf("Expected:\n%v\n Retrieved:\n%v\n", td, storedTD)
+		}
+	})
+}
+
 func TestPatch(t *testing.T) {
 	t.Cleanup(func() {
 		writeTestResult("partially-update-thing", "", t)
 	})
 
-	t.Run("Update title", func(t *testing.T) {
-		// add a new TD
+	for _, tc := range patchMatrix {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			runPatchCase(t, tc, MediaTypeMergePatch, tc.mergePatchBody)
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("json-patch-update-thing", "", t)
+	})
+
+	for _, tc := range patchMatrix {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			runPatchCase(t, tc, MediaTypeJSONPatch, tc.jsonPatchBody)
+		})
+	}
+
+	t.Run("move", func(t *testing.T) {
 		id := "urn:uuid:" + uuid.NewV4().String()
 		td := mockedTD(id)
+		td["description"] = "to be moved"
 		createThing(id, td, t)
 
-		// update the title
-		jsonTD := `{"title": "new title"}`
-
-		// submit PATCH request
-		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(jsonTD))
+		body := `[{"op": "move", "from": "/description", "path": "/title"}]`
+		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeJSONPatch, []byte(body))
 		if err != nil {
 			t.Fatalf("Error patching TD: %s", err)
 		}
 		defer res.Body.Close()
 
-		body := httpReadBody(res, t)
+		resBody := httpReadBody(res, t)
 
 		t.Run("status code", func(t *testing.T) {
-			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, resBody, t)
 		})
 
 		t.Run("result", func(t *testing.T) {
-			// retrieve the changed TD
 			storedTD := retrieveThing(id, t)
 
-			// manually change attributes of the reference TD
-			td["title"] = "new title"
-			// set system-generated attributes
+			delete(td, "description")
+			td["title"] = "to be moved"
 			td["registration"] = storedTD["registration"]
 
 			if !serializedEqual(td, storedTD) {
@@ -274,174 +526,100 @@ func TestPatch(t *testing.T) {
 		})
 	})
 
-	t.Run("Remove description", func(t *testing.T) {
-		// add a new TD
+	t.Run("copy", func(t *testing.T) {
 		id := "urn:uuid:" + uuid.NewV4().String()
 		td := mockedTD(id)
-		td["description"] = "this is a test descr"
+		td["description"] = "copy me"
 		createThing(id, td, t)
 
-		// set description to null to remove it
-		jsonTD := `{"description": null}`
-
-		// submit PATCH request
-		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(jsonTD))
+		body := `[{"op": "copy", "from": "/description", "path": "/title"}]`
+		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeJSONPatch, []byte(body))
 		if err != nil {
 			t.Fatalf("Error patching TD: %s", err)
 		}
 		defer res.Body.Close()
 
-		body := httpReadBody(res, t)
+		resBody := httpReadBody(res, t)
 
 		t.Run("status code", func(t *testing.T) {
-			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, resBody, t)
 		})
 
 		t.Run("result", func(t *testing.T) {
-			// retrieve the changed TD
 			storedTD := retrieveThing(id, t)
 
-			// manually change attributes of the reference TD
-			delete(td, "description")
-			// set system-generated attributes
+			td["title"] = "copy me"
 			td["registration"] = storedTD["registration"]
 
 			if !serializedEqual(td, storedTD) {
-				t.Fatalf("Posted:\n%v\n Retrieved:\n%v\n", td, storedTD)
+				t.Fatalf("Expected:\n%v\n Retrieved:\n%v\n", td, storedTD)
 			}
 		})
 	})
 
-	t.Run("Patch properties object", func(t *testing.T) {
-		// add a new TD
+	t.Run("failed test op leaves TD unchanged", func(t *testing.T) {
 		id := "urn:uuid:" + uuid.NewV4().String()
 		td := mockedTD(id)
-		td["properties"] = map[string]interface{}{
-			"status": map[string]interface{}{
-				"forms": []map[string]interface{}{
-					{"href": "https://mylamp.example.com/status"},
-				},
-			},
-		}
 		createThing(id, td, t)
 
-		// patch with new property
-		jsonTD := `{"properties": {"new_property": {"forms": [{"href": "https://mylamp.example.com/new_property"}]}}}`
-
-		// submit PATCH request
-		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(jsonTD))
+		body := `[
+			{"op": "test", "path": "/title", "value": "does-not-match"},
+			{"op": "replace", "path": "/title", "value": "should not apply"}
+		]`
+		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeJSONPatch, []byte(body))
 		if err != nil {
 			t.Fatalf("Error patching TD: %s", err)
 		}
 		defer res.Body.Close()
 
-		body := httpReadBody(res, t)
+		resBody := httpReadBody(res, t)
 
 		t.Run("status code", func(t *testing.T) {
-			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+			if res.StatusCode != http.StatusConflict && res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected 409 or 400 for a failed test op, got %d:\n%s", res.StatusCode, resBody)
+			}
 		})
 
-		t.Run("result", func(t *testing.T) {
-			// retrieve the changed TD
+		t.Run("result unchanged", func(t *testing.T) {
 			storedTD := retrieveThing(id, t)
-
-			// manually change attributes of the reference TD
-			td["properties"] = map[string]interface{}{
-				"status": map[string]interface{}{
-					"forms": []map[string]interface{}{
-						{"href": "https://mylamp.example.com/status"},
-					},
-				},
-				"new_property": map[string]interface{}{
-					"forms": []map[string]interface{}{
-						{"href": "https://mylamp.example.com/new_property"},
-					},
-				},
-			}
-			// set system-generated attributes
-			td["registration"] = storedTD["registration"]
-
-			if !serializedEqual(td, storedTD) {
-				t.Fatalf("Expected:\n%v\n Retrieved:\n%v\n", td, storedTD)
+			if storedTD["title"] != td["title"] {
+				t.Fatalf("TD was mutated despite a failed test op: %v", storedTD)
 			}
 		})
 	})
+}
 
-	t.Run("Patch array", func(t *testing.T) {
-		// add a new TD
-		id := "urn:uuid:" + uuid.NewV4().String()
-		td := mockedTD(id)
-		td["properties"] = map[string]interface{}{
-			"status": map[string]interface{}{
-				"forms": []map[string]interface{}{
-					{"href": "https://mylamp.example.com/status"},
-				},
-			},
-		}
-		createThing(id, td, t)
+func TestPatchContentTypeMismatch(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("patch-content-type-mismatch", "", t)
+	})
 
-		// patch with different array
-		jsonTD := `{"properties": {"status": {"forms": [
-					{"href": "https://mylamp.example.com/status"},
-					{"href": "coaps://mylamp.example.com/status"}
-				]}}}`
+	t.Run("merge-patch body sent as json-patch", func(t *testing.T) {
+		id := "urn:uuid:" + uuid.NewV4().String()
+		createThing(id, mockedTD(id), t)
 
-		// submit PATCH request
-		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(jsonTD))
+		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeJSONPatch, []byte(`{"title": "mismatched"}`))
 		if err != nil {
 			t.Fatalf("Error patching TD: %s", err)
 		}
 		defer res.Body.Close()
 
 		body := httpReadBody(res, t)
-
-		t.Run("status code", func(t *testing.T) {
-			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
-		})
-
-		t.Run("result", func(t *testing.T) {
-			// retrieve the changed TD
-			storedTD := retrieveThing(id, t)
-
-			// manually change attributes of the reference TD
-			td["properties"] = map[string]interface{}{
-				"status": map[string]interface{}{
-					"forms": []map[string]interface{}{
-						{"href": "https://mylamp.example.com/status"},
-						{"href": "coaps://mylamp.example.com/status"},
-					},
-				},
-			}
-			// set system-generated attributes
-			td["registration"] = storedTD["registration"]
-
-			if !serializedEqual(td, storedTD) {
-				t.Fatalf("Expected:\n%v\n Retrieved:\n%v\n", td, storedTD)
-			}
-		})
+		assertStatusCode(res.StatusCode, http.StatusUnsupportedMediaType, body, t)
 	})
 
-	t.Run("Fail removing mandatory title", func(t *testing.T) {
-		// add a new TD
+	t.Run("json-patch body sent as merge-patch", func(t *testing.T) {
 		id := "urn:uuid:" + uuid.NewV4().String()
-		td := mockedTD(id)
-		createThing(id, td, t)
-
-		// set title to null to remove it
-		jsonTD := `{"title": null}`
+		createThing(id, mockedTD(id), t)
 
-		// submit PATCH request
-		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(jsonTD))
+		res, err := httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(`[{"op": "replace", "path": "/title", "value": "mismatched"}]`))
 		if err != nil {
 			t.Fatalf("Error patching TD: %s", err)
 		}
 		defer res.Body.Close()
 
 		body := httpReadBody(res, t)
-
-		t.Run("status code", func(t *testing.T) {
-			assertStatusCode(res.StatusCode, http.StatusBadRequest, body, t)
-		})
+		assertStatusCode(res.StatusCode, http.StatusUnsupportedMediaType, body, t)
 	})
 }
 
@@ -548,3 +726,531 @@ func TestListThings(t *testing.T) {
 	})
 
 }
+
+func TestEvents(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("events", "", t)
+	})
+
+	t.Run("lifecycle events", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		events, stop := subscribeSSE(ctx, t, serverURL+"/events", "")
+		defer stop()
+
+		id := "urn:uuid:" + uuid.NewV4().String()
+		td := mockedTD(id)
+		createThing(id, td, t)
+
+		created := waitForEvent(t, events, "thing_created", 5*time.Second)
+		assertEventRefersTo(created, id, t)
+
+		td["title"] = "updated via events test"
+		b, _ := json.Marshal(td)
+		res, err := httpPut(serverURL+"/things/"+id, MediaTypeThingDescription, b)
+		if err != nil {
+			t.Fatalf("Error putting TD: %s", err)
+		}
+		res.Body.Close()
+
+		updated := waitForEvent(t, events, "thing_updated", 5*time.Second)
+		assertEventRefersTo(updated, id, t)
+
+		res, err = httpPatch(serverURL+"/things/"+id, MediaTypeMergePatch, []byte(`{"title": "patched via events test"}`))
+		if err != nil {
+			t.Fatalf("Error patching TD: %s", err)
+		}
+		res.Body.Close()
+
+		patched := waitForEvent(t, events, "thing_updated", 5*time.Second)
+		assertEventRefersTo(patched, id, t)
+
+		res, err = httpDelete(serverURL + "/things/" + id)
+		if err != nil {
+			t.Fatalf("Error deleting TD: %s", err)
+		}
+		res.Body.Close()
+
+		deleted := waitForEvent(t, events, "thing_deleted", 5*time.Second)
+		assertEventRefersTo(deleted, id, t)
+
+		t.Run("ids are monotonically increasing", func(t *testing.T) {
+			ids := []string{created.id, updated.id, patched.id, deleted.id}
+			prev, err := strconv.ParseInt(ids[0], 10, 64)
+			if err != nil {
+				t.Fatalf("Event id %q is not usable as a Last-Event-ID cursor: %s", ids[0], err)
+			}
+			for _, raw := range ids[1:] {
+				cur, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil {
+					t.Fatalf("Event id %q is not usable as a Last-Event-ID cursor: %s", raw, err)
+				}
+				if cur <= prev {
+					t.Fatalf("Event ids are not monotonically increasing: %d then %d", prev, cur)
+				}
+				prev = cur
+			}
+		})
+	})
+
+	t.Run("filter by event type", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		events, stop := subscribeSSE(ctx, t, serverURL+"/events/thing_created", "")
+		defer stop()
+
+		id := "urn:uuid:" + uuid.NewV4().String()
+		td := mockedTD(id)
+		createThing(id, td, t)
+
+		ev := waitForEvent(t, events, "thing_created", 5*time.Second)
+		assertEventRefersTo(ev, id, t)
+
+		// deleting the TD should not surface on a stream filtered to thing_created
+		res, err := httpDelete(serverURL + "/things/" + id)
+		if err != nil {
+			t.Fatalf("Error deleting TD: %s", err)
+		}
+		res.Body.Close()
+
+		select {
+		case ev, ok := <-events:
+			if ok && ev.event != "thing_created" {
+				t.Fatalf("Filtered stream emitted unexpected event type %q", ev.event)
+			}
+		case <-time.After(2 * time.Second):
+			// no further thing_created events, as expected
+		}
+	})
+
+	t.Run("reconnect with Last-Event-ID replays missed events", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		events, stop := subscribeSSE(ctx, t, serverURL+"/events", "")
+
+		id := "urn:uuid:" + uuid.NewV4().String()
+		td := mockedTD(id)
+		createThing(id, td, t)
+
+		created := waitForEvent(t, events, "thing_created", 5*time.Second)
+		stop()
+
+		// perform a second mutation while disconnected
+		td["title"] = "updated while disconnected"
+		b, _ := json.Marshal(td)
+		res, err := httpPut(serverURL+"/things/"+id, MediaTypeThingDescription, b)
+		if err != nil {
+			t.Fatalf("Error putting TD: %s", err)
+		}
+		res.Body.Close()
+
+		replay, stopReplay := subscribeSSE(ctx, t, serverURL+"/events", created.id)
+		defer stopReplay()
+
+		missed := waitForEvent(t, replay, "thing_updated", 5*time.Second)
+		assertEventRefersTo(missed, id, t)
+	})
+}
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+
+// nextPageURL extracts the URL pointing at the next page from a collection
+// response's Link header, or "" if there isn't one.
+func nextPageURL(res *http.Response, t *testing.T) string {
+	t.Helper()
+
+	for _, link := range res.Header.Values("Link") {
+		if m := linkNextRe.FindStringSubmatch(link); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func TestListThingsPagination(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("list-things-pagination", "", t)
+	})
+
+	const limit = 5
+	const seedCount = 12
+
+	seeded := make(map[string]bool, seedCount)
+	for i := 0; i < seedCount; i++ {
+		id := "urn:uuid:" + uuid.NewV4().String()
+		createThing(id, mockedTD(id), t)
+		seeded[id] = true
+	}
+
+	t.Run("walk pages by Link header", func(t *testing.T) {
+		seen := make(map[string]int, seedCount)
+		pageURL := serverURL + "/things?limit=" + strconv.Itoa(limit)
+
+		// The directory accumulates TDs left behind by other tests (and,
+		// against a long-lived server, by previous runs), so the number of
+		// pages to walk before finding all seeded TDs isn't bounded by
+		// seedCount. Stop as soon as every seeded TD has been seen. Rather
+		// than cap the total page count (which would reintroduce the same
+		// coupling to directory size), bail out as soon as a run of pages
+		// goes by without turning up a single new seeded TD - that's what a
+		// stuck or cyclic Link header looks like, regardless of how much
+		// unrelated state is sitting in front of our fixtures.
+		const maxStalePages = 200
+		stale := 0
+		for pageURL != "" && len(seen) < seedCount {
+			res, err := http.Get(pageURL)
+			if err != nil {
+				t.Fatalf("Error getting page: %s", err)
+			}
+			body := httpReadBody(res, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+
+			var collection []mapAny
+			if err := json.Unmarshal(body, &collection); err != nil {
+				t.Fatalf("Error decoding page: %s", err)
+			}
+			if len(collection) > limit {
+				t.Fatalf("Page returned %d items, more than requested limit %d", len(collection), limit)
+			}
+
+			before := len(seen)
+			for _, td := range collection {
+				if tdID, _ := td["id"].(string); tdID != "" && seeded[tdID] {
+					seen[tdID]++
+				}
+			}
+			if len(seen) > before {
+				stale = 0
+			} else {
+				stale++
+				if stale >= maxStalePages {
+					t.Fatalf("No new seeded TDs found in %d consecutive pages, possible stuck or cyclic Link header", maxStalePages)
+				}
+			}
+
+			pageURL = nextPageURL(res, t)
+			res.Body.Close()
+		}
+
+		for id := range seeded {
+			if seen[id] != 1 {
+				t.Fatalf("Expected seeded TD %s to appear exactly once across pages, seen %d times", id, seen[id])
+			}
+		}
+	})
+
+	t.Run("rejects invalid limit", func(t *testing.T) {
+		for _, limit := range []string{"not-a-number", "-1", "0"} {
+			res, err := http.Get(serverURL + "/things?limit=" + limit)
+			if err != nil {
+				t.Fatalf("Error getting list of TDs: %s", err)
+			}
+			body := httpReadBody(res, t)
+			res.Body.Close()
+
+			t.Run("limit="+limit, func(t *testing.T) {
+				assertStatusCode(res.StatusCode, http.StatusBadRequest, body, t)
+			})
+		}
+	})
+
+	t.Run("sort_by title is respected", func(t *testing.T) {
+		// mockedTD always returns the same title, so seed our own fixtures
+		// with distinct titles; otherwise the sortedness check on a
+		// collection of identical titles would trivially pass even if the
+		// server ignored sort_by entirely.
+		wantTitles := []string{"aardvark-sort-fixture", "mid-sort-fixture", "zzz-sort-fixture"}
+		fixtureTitles := make(map[string]string, len(wantTitles))
+		for _, title := range wantTitles {
+			id := "urn:uuid:" + uuid.NewV4().String()
+			td := mockedTD(id)
+			td["title"] = title
+			createThing(id, td, t)
+			fixtureTitles[id] = title
+		}
+
+		res, err := http.Get(serverURL + "/things?sort_by=title")
+		if err != nil {
+			t.Fatalf("Error getting sorted list of TDs: %s", err)
+		}
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+
+		var collection []mapAny
+		if err := json.Unmarshal(body, &collection); err != nil {
+			t.Fatalf("Error decoding collection: %s", err)
+		}
+
+		seenCount := make(map[string]int, len(fixtureTitles))
+		var seenTitles []string
+		for _, td := range collection {
+			id, _ := td["id"].(string)
+			if title, ok := fixtureTitles[id]; ok {
+				seenCount[id]++
+				seenTitles = append(seenTitles, title)
+			}
+		}
+
+		// Check each fixture individually rather than just the overall
+		// count, so a server that drops one fixture while duplicating
+		// another (same count, wrong set) doesn't slip past undetected.
+		for id, title := range fixtureTitles {
+			if seenCount[id] != 1 {
+				t.Fatalf("Expected fixture %q (title %q) to appear exactly once in the collection, saw %d times", id, title, seenCount[id])
+			}
+		}
+		if !sort.StringsAreSorted(seenTitles) {
+			t.Fatalf("Seeded fixtures are not returned in title order: %v", seenTitles)
+		}
+	})
+}
+
+// jsonPathQuery issues a JSONPath search and decodes the resulting array of
+// matches as strings (e.g. TD ids).
+func jsonPathQuery(query string, t *testing.T) []string {
+	t.Helper()
+
+	res, err := http.Get(serverURL + "/search/jsonpath?query=" + url.QueryEscape(query))
+	if err != nil {
+		t.Fatalf("Error querying jsonpath: %s", err)
+	}
+	defer res.Body.Close()
+
+	body := httpReadBody(res, t)
+	assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+
+	var matches []string
+	if err := json.Unmarshal(body, &matches); err != nil {
+		t.Fatalf("Error decoding jsonpath result: %s", err)
+	}
+	return matches
+}
+
+func assertJSONPathResult(got, want []string, t *testing.T) {
+	t.Helper()
+
+	gotSorted := append([]string(nil), got...)
+	wantSorted := append([]string(nil), want...)
+	sort.Strings(gotSorted)
+	sort.Strings(wantSorted)
+
+	if len(gotSorted) != len(wantSorted) {
+		t.Fatalf("Expected JSONPath result %v, got %v", want, got)
+	}
+	for i := range gotSorted {
+		if gotSorted[i] != wantSorted[i] {
+			t.Fatalf("Expected JSONPath result %v, got %v", want, got)
+		}
+	}
+}
+
+func TestSearchJSONPath(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("search-jsonpath", "", t)
+	})
+
+	titles := []string{"lamp-a", "lamp-b", "thermostat-o'brien"}
+	types := []string{"Lamp", "Lamp", "Thermostat"}
+	ids := make([]string, len(titles))
+
+	for i, title := range titles {
+		id := "urn:uuid:" + uuid.NewV4().String()
+		td := mockedTD(id)
+		td["title"] = title
+		td["@type"] = types[i]
+		td["properties"] = mapAny{
+			"status": mapAny{
+				"forms": []mapAny{{"href": "https://example.com/" + strconv.Itoa(i)}},
+			},
+		}
+		createThing(id, td, t)
+		ids[i] = id
+	}
+
+	t.Run("query by title", func(t *testing.T) {
+		got := jsonPathQuery(`$[?(@.title=='lamp-a')].id`, t)
+		assertJSONPathResult(got, []string{ids[0]}, t)
+	})
+
+	t.Run("query by @type", func(t *testing.T) {
+		got := jsonPathQuery(`$[?(@["@type"]=='Lamp')].id`, t)
+		assertJSONPathResult(got, []string{ids[0], ids[1]}, t)
+	})
+
+	t.Run("escaped quote in literal", func(t *testing.T) {
+		got := jsonPathQuery(`$[?(@.title=='thermostat-o\'brien')].id`, t)
+		assertJSONPathResult(got, []string{ids[2]}, t)
+	})
+
+	t.Run("malformed query", func(t *testing.T) {
+		res, err := http.Get(serverURL + "/search/jsonpath?query=" + url.QueryEscape(`$[?(@.title=='unterminated`))
+		if err != nil {
+			t.Fatalf("Error querying jsonpath: %s", err)
+		}
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusBadRequest, body, t)
+	})
+}
+
+// TestETag covers optimistic-concurrency handling via conditional requests.
+// ETag support is optional in the WoT Discovery spec: the suite skips
+// cleanly if the server omits the header on a plain GET, but once a server
+// advertises an ETag it is held to the full contract below.
+func TestETag(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("etag", "", t)
+	})
+
+	id := "urn:uuid:" + uuid.NewV4().String()
+	td := mockedTD(id)
+	createThing(id, td, t)
+
+	res, err := http.Get(serverURL + "/things/" + id)
+	if err != nil {
+		t.Fatalf("Error getting TD: %s", err)
+	}
+	httpReadBody(res, t)
+	res.Body.Close()
+
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Skip("Server does not advertise ETag support")
+	}
+
+	t.Run("If-Match succeeds and changes ETag", func(t *testing.T) {
+		td["title"] = "updated with if-match"
+		b, _ := json.Marshal(td)
+
+		req, err := http.NewRequest(http.MethodPut, serverURL+"/things/"+id, bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Error building request: %s", err)
+		}
+		req.Header.Set("Content-Type", MediaTypeThingDescription)
+		req.Header.Set("If-Match", etag)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error putting TD: %s", err)
+		}
+		body := httpReadBody(res, t)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 200 or 204 for a matching If-Match, got %d:\n%s", res.StatusCode, body)
+		}
+
+		follow, err := http.Get(serverURL + "/things/" + id)
+		if err != nil {
+			t.Fatalf("Error getting TD: %s", err)
+		}
+		httpReadBody(follow, t)
+		follow.Body.Close()
+
+		newETag := follow.Header.Get("ETag")
+		if newETag == "" {
+			t.Fatalf("Server advertised an ETag but omitted it after a mutation")
+		}
+		if newETag == etag {
+			t.Fatalf("ETag did not change after a successful mutation")
+		}
+		etag = newETag
+	})
+
+	t.Run("stale If-Match is rejected", func(t *testing.T) {
+		td["title"] = "attempted update with stale etag"
+		b, _ := json.Marshal(td)
+
+		req, err := http.NewRequest(http.MethodPut, serverURL+"/things/"+id, bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Error building request: %s", err)
+		}
+		req.Header.Set("Content-Type", MediaTypeThingDescription)
+		req.Header.Set("If-Match", `"stale-etag-value"`)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error putting TD: %s", err)
+		}
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		t.Run("status code", func(t *testing.T) {
+			assertStatusCode(res.StatusCode, http.StatusPreconditionFailed, body, t)
+		})
+
+		t.Run("stored TD unchanged", func(t *testing.T) {
+			stored := retrieveThing(id, t)
+			if stored["title"] == "attempted update with stale etag" {
+				t.Fatalf("Stored TD was mutated despite a stale If-Match")
+			}
+		})
+	})
+
+	t.Run("If-None-Match returns 304", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, serverURL+"/things/"+id, nil)
+		if err != nil {
+			t.Fatalf("Error building request: %s", err)
+		}
+		req.Header.Set("If-None-Match", etag)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error getting TD: %s", err)
+		}
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		t.Run("status code", func(t *testing.T) {
+			assertStatusCode(res.StatusCode, http.StatusNotModified, body, t)
+		})
+
+		t.Run("empty body", func(t *testing.T) {
+			if len(body) != 0 {
+				t.Fatalf("Expected empty body for 304 Not Modified, got %d bytes", len(body))
+			}
+		})
+	})
+
+	t.Run("DELETE with If-Match", func(t *testing.T) {
+		t.Run("stale tag fails", func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, serverURL+"/things/"+id, nil)
+			if err != nil {
+				t.Fatalf("Error building request: %s", err)
+			}
+			req.Header.Set("If-Match", `"stale-etag-value"`)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Error deleting TD: %s", err)
+			}
+			defer res.Body.Close()
+
+			body := httpReadBody(res, t)
+			assertStatusCode(res.StatusCode, http.StatusPreconditionFailed, body, t)
+		})
+
+		t.Run("current tag succeeds", func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, serverURL+"/things/"+id, nil)
+			if err != nil {
+				t.Fatalf("Error building request: %s", err)
+			}
+			req.Header.Set("If-Match", etag)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Error deleting TD: %s", err)
+			}
+			defer res.Body.Close()
+
+			body := httpReadBody(res, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+		})
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	MediaTypeSPARQLQuery   = "application/sparql-query"
+	MediaTypeSPARQLResults = "application/sparql-results+json"
+	MediaTypeTurtle        = "text/turtle"
+)
+
+// sparqlResults mirrors the W3C SPARQL 1.1 Query Results JSON Format,
+// covering both the SELECT (bindings) and ASK (boolean) response shapes.
+type sparqlResults struct {
+	Head struct {
+		Vars []string `json:"vars"`
+	} `json:"head"`
+	Results struct {
+		Bindings []map[string]sparqlBinding `json:"bindings"`
+	} `json:"results"`
+	Boolean *bool `json:"boolean,omitempty"`
+}
+
+type sparqlBinding struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// httpSPARQLQuery POSTs a SPARQL 1.1 query with the given Accept header and
+// returns the raw response for the caller to inspect.
+func httpSPARQLQuery(query string, accept string, t *testing.T) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/search/sparql", strings.NewReader(query))
+	if err != nil {
+		t.Fatalf("Error building SPARQL request: %s", err)
+	}
+	req.Header.Set("Content-Type", MediaTypeSPARQLQuery)
+	req.Header.Set("Accept", accept)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error posting SPARQL query: %s", err)
+	}
+	return res
+}
+
+// assertSPARQLBinding asserts that bindings contains a row where variable is
+// bound to value (and, if bindingType is non-empty, to that RDF term type).
+func assertSPARQLBinding(bindings []map[string]sparqlBinding, variable, value, bindingType string, t *testing.T) {
+	t.Helper()
+
+	for _, row := range bindings {
+		b, ok := row[variable]
+		if !ok || b.Value != value {
+			continue
+		}
+		if bindingType != "" && b.Type != bindingType {
+			continue
+		}
+		return
+	}
+	t.Fatalf("No binding found for ?%s = %q (type %q) in %v", variable, value, bindingType, bindings)
+}
+
+func TestSPARQL(t *testing.T) {
+	t.Cleanup(func() {
+		writeTestResult("sparql", "", t)
+	})
+
+	const sharedType = "SPARQLFixtureThing"
+
+	id1 := "urn:uuid:" + uuid.NewV4().String()
+	td1 := mockedTD(id1)
+	td1["@type"] = sharedType
+	createThing(id1, td1, t)
+
+	id2 := "urn:uuid:" + uuid.NewV4().String()
+	td2 := mockedTD(id2)
+	td2["@type"] = sharedType
+	createThing(id2, td2, t)
+
+	t.Run("SELECT", func(t *testing.T) {
+		query := `SELECT ?s WHERE { ?s a <` + sharedType + `> }`
+		res := httpSPARQLQuery(query, MediaTypeSPARQLResults, t)
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+
+		t.Run("status code", func(t *testing.T) {
+			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+		})
+
+		t.Run("content type", func(t *testing.T) {
+			assertContentMediaType(res.Header.Get("Content-Type"), MediaTypeSPARQLResults, t)
+		})
+
+		t.Run("result shape", func(t *testing.T) {
+			var results sparqlResults
+			if err := json.Unmarshal(body, &results); err != nil {
+				t.Fatalf("Error decoding SPARQL results: %s", err)
+			}
+			if len(results.Head.Vars) == 0 {
+				t.Fatalf("Expected head.vars to list the bound variables, got none")
+			}
+			assertSPARQLBinding(results.Results.Bindings, "s", id1, "uri", t)
+			assertSPARQLBinding(results.Results.Bindings, "s", id2, "uri", t)
+		})
+	})
+
+	t.Run("SELECT COUNT traverses cross-TD data", func(t *testing.T) {
+		query := `SELECT (COUNT(?s) AS ?c) WHERE { ?s a <` + sharedType + `> }`
+		res := httpSPARQLQuery(query, MediaTypeSPARQLResults, t)
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+
+		var results sparqlResults
+		if err := json.Unmarshal(body, &results); err != nil {
+			t.Fatalf("Error decoding SPARQL results: %s", err)
+		}
+		if len(results.Results.Bindings) != 1 {
+			t.Fatalf("Expected a single aggregate row, got %d", len(results.Results.Bindings))
+		}
+		if count := results.Results.Bindings[0]["c"].Value; count != "2" {
+			t.Fatalf("Expected count of 2 shared TDs, got %s", count)
+		}
+	})
+
+	t.Run("ASK", func(t *testing.T) {
+		query := `ASK { ?s a <` + sharedType + `> }`
+		res := httpSPARQLQuery(query, MediaTypeSPARQLResults, t)
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+
+		var results sparqlResults
+		if err := json.Unmarshal(body, &results); err != nil {
+			t.Fatalf("Error decoding ASK results: %s", err)
+		}
+		if results.Boolean == nil {
+			t.Fatalf("Expected a boolean field in the ASK response, got none")
+		}
+		if !*results.Boolean {
+			t.Fatalf("Expected ASK to return true for an existing TD, got false")
+		}
+	})
+
+	t.Run("CONSTRUCT content negotiation", func(t *testing.T) {
+		query := `CONSTRUCT { ?s a <` + sharedType + `> } WHERE { ?s a <` + sharedType + `> }`
+
+		t.Run("turtle", func(t *testing.T) {
+			res := httpSPARQLQuery(query, MediaTypeTurtle, t)
+			defer res.Body.Close()
+
+			body := httpReadBody(res, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+			assertContentMediaType(res.Header.Get("Content-Type"), MediaTypeTurtle, t)
+		})
+
+		t.Run("json-ld", func(t *testing.T) {
+			res := httpSPARQLQuery(query, MediaTypeJSONLD, t)
+			defer res.Body.Close()
+
+			body := httpReadBody(res, t)
+			assertStatusCode(res.StatusCode, http.StatusOK, body, t)
+			assertContentMediaType(res.Header.Get("Content-Type"), MediaTypeJSONLD, t)
+		})
+	})
+
+	t.Run("invalid query syntax", func(t *testing.T) {
+		res := httpSPARQLQuery(`SELECT ?s WHERE { ?s a`, MediaTypeSPARQLResults, t)
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusBadRequest, body, t)
+	})
+
+	t.Run("unsupported Accept header", func(t *testing.T) {
+		query := `SELECT ?s WHERE { ?s a <` + sharedType + `> }`
+		res := httpSPARQLQuery(query, "application/unsupported-format", t)
+		defer res.Body.Close()
+
+		body := httpReadBody(res, t)
+		assertStatusCode(res.StatusCode, http.StatusNotAcceptable, body, t)
+	})
+}